@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider"
+)
+
+// mountResyncPeriod is how often we re-evaluate EBS attach/detach state,
+// independent of the node informer's event stream.
+const mountResyncPeriod = 30 * time.Second
+
+// Controller reconciles Node objects: it deletes nodes whose backing
+// instance has disappeared, and, in legacy in-tree mode, keeps pending EBS
+// volumes attached/detached to match each node's VolumesInUse. Only the
+// elected leader runs a
+// Controller, so a given node or volume is only ever acted on once.
+type Controller struct {
+	clientset *kubernetes.Clientset
+
+	// providers maps a Node's providerID scheme ("aws", "kubevirt") to the
+	// cloudprovider.Provider that can act on it.
+	providers map[string]cloudprovider.Provider
+
+	nodeLister  corelisters.NodeLister
+	nodesSynced cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+
+	// legacyInTree selects the volume reconciliation path: patching
+	// Node.status.volumesAttached directly on a poll loop (true) versus
+	// letting a VolumeAttachmentController drive VolumeAttachment objects
+	// as a CSI external-attacher would (false, the caller's job to start).
+	legacyInTree bool
+
+	drainOptions DrainOptions
+}
+
+// NewController wires up a Controller against the given shared informer.
+// It does not start processing until Run is called.
+func NewController(clientset *kubernetes.Clientset, nodeInformer coreinformers.NodeInformer, providers map[string]cloudprovider.Provider, legacyInTree bool, drainOptions DrainOptions) *Controller {
+	c := &Controller{
+		clientset:    clientset,
+		providers:    providers,
+		nodeLister:   nodeInformer.Lister(),
+		nodesSynced:  nodeInformer.Informer().HasSynced,
+		queue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nodes"),
+		legacyInTree: legacyInTree,
+		drainOptions: drainOptions,
+	}
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueNode,
+		UpdateFunc: func(old, new interface{}) { c.enqueueNode(new) },
+	})
+
+	return c
+}
+
+func (c *Controller) enqueueNode(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the given number of reconcile workers plus, in legacy in-tree
+// mode, the EBS mount resync loop, and blocks until stopCh is closed.
+func (c *Controller) Run(workers int, stopCh <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.InfoS("Starting node-cleanup controller")
+
+	if !cache.WaitForCacheSync(stopCh, c.nodesSynced) {
+		return fmt.Errorf("failed to wait for node informer cache to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	if c.legacyInTree {
+		go wait.Until(func() { mountPendingEBSVolumes(context.Background(), c.clientset, c.providers) }, mountResyncPeriod, stopCh)
+	}
+
+	<-stopCh
+	klog.InfoS("Shutting down node-cleanup controller")
+	return nil
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(key.(string)); err != nil {
+		c.queue.AddRateLimited(key)
+		runtime.HandleError(fmt.Errorf("error syncing node %q: %w, requeuing", key, err))
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) reconcile(name string) error {
+	reconcilesTotal.Inc()
+
+	node, err := c.nodeLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if hasReadyCondition(node.Status.Conditions) {
+		return nil
+	}
+
+	provider, ok := c.providers[cloudprovider.Scheme(node.Spec.ProviderID)]
+	if !ok {
+		return fmt.Errorf("no cloud provider registered for node %s (providerID %q)", node.Name, node.Spec.ProviderID)
+	}
+
+	ctx := context.Background()
+	if shouldRemoveNode(ctx, provider, *node) {
+		klog.InfoS("Draining and removing node", "node", node.Name)
+		if err := drainAndDeleteNode(ctx, c.clientset, node, c.drainOptions); err != nil {
+			return err
+		}
+		nodesDeletedTotal.Inc()
+		return nil
+	}
+	klog.InfoS("Node seems unresponsive, but alive", "node", node.Name)
+	return nil
+}
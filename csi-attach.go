@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	storageinformers "k8s.io/client-go/informers/storage/v1"
+	"k8s.io/client-go/kubernetes"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider"
+)
+
+// ebsCSIDriverName is the attacher name used by aws-ebs-csi-driver. We only
+// react to VolumeAttachments created for this driver.
+const ebsCSIDriverName = "ebs.csi.aws.com"
+
+// ebsAttacherFinalizer mirrors the finalizer the real external-attacher
+// places on a VolumeAttachment it owns, so the object can't be garbage
+// collected before ControllerUnpublishVolume has actually run and the EC2
+// attachment is torn down.
+const ebsAttacherFinalizer = "external-attacher/" + ebsCSIDriverName
+
+// volumeHandleForAttachment resolves the EBS volume ID backing a
+// VolumeAttachment by following its PersistentVolumeName to the underlying
+// CSI volume handle, the same way external-attacher does.
+func volumeHandleForAttachment(ctx context.Context, clientset *kubernetes.Clientset, va *storagev1.VolumeAttachment) (string, error) {
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return "", nil
+	}
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, *va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pv.Spec.CSI == nil {
+		return "", nil
+	}
+	return pv.Spec.CSI.VolumeHandle, nil
+}
+
+func patchVolumeAttachmentStatus(ctx context.Context, clientset *kubernetes.Clientset, va *storagev1.VolumeAttachment, attached bool, devicePath string) error {
+	status := storagev1.VolumeAttachmentStatus{
+		Attached: attached,
+	}
+	if devicePath != "" {
+		status.AttachmentMetadata = map[string]string{"devicePath": devicePath}
+	}
+	patchData, err := json.Marshal([]map[string]interface{}{
+		{
+			"op":    "replace",
+			"path":  "/status",
+			"value": status,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.StorageV1().VolumeAttachments().Patch(ctx, va.Name, types.JSONPatchType, patchData, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// devicesInUseOnNode lists the device paths already claimed by other
+// VolumeAttachments attached to nodeName, by reading back
+// status.attachmentMetadata["devicePath"] the way external-attacher
+// populates it. Unlike the legacy in-tree path, the CSI path never writes
+// Node.status.volumesAttached, so that field can't tell us what's free.
+func devicesInUseOnNode(vaLister storagelisters.VolumeAttachmentLister, nodeName string, except string) ([]string, error) {
+	vas, err := vaLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]string, 0, len(vas))
+	for _, va := range vas {
+		if va.Spec.NodeName != nodeName || va.Name == except || !va.Status.Attached {
+			continue
+		}
+		if dev := va.Status.AttachmentMetadata["devicePath"]; dev != "" {
+			devices = append(devices, dev)
+		}
+	}
+	return devices, nil
+}
+
+func hasFinalizer(va *storagev1.VolumeAttachment, finalizer string) bool {
+	for _, f := range va.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func patchVolumeAttachmentFinalizers(ctx context.Context, clientset *kubernetes.Clientset, va *storagev1.VolumeAttachment, finalizers []string) error {
+	patchData, err := json.Marshal([]map[string]interface{}{
+		{
+			"op":    "replace",
+			"path":  "/metadata/finalizers",
+			"value": finalizers,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.StorageV1().VolumeAttachments().Patch(ctx, va.Name, types.JSONPatchType, patchData, metav1.PatchOptions{})
+	return err
+}
+
+func addAttacherFinalizer(ctx context.Context, clientset *kubernetes.Clientset, va *storagev1.VolumeAttachment) error {
+	if hasFinalizer(va, ebsAttacherFinalizer) {
+		return nil
+	}
+	return patchVolumeAttachmentFinalizers(ctx, clientset, va, append(va.Finalizers, ebsAttacherFinalizer))
+}
+
+func removeAttacherFinalizer(ctx context.Context, clientset *kubernetes.Clientset, va *storagev1.VolumeAttachment) error {
+	if !hasFinalizer(va, ebsAttacherFinalizer) {
+		return nil
+	}
+	finalizers := make([]string, 0, len(va.Finalizers))
+	for _, f := range va.Finalizers {
+		if f != ebsAttacherFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	return patchVolumeAttachmentFinalizers(ctx, clientset, va, finalizers)
+}
+
+// VolumeAttachmentController implements the external-attacher pattern for
+// ebsCSIDriverName: it drives VolumeAttachment.status.attached to match
+// VolumeAttachment.spec, calling ControllerPublishVolume/
+// ControllerUnpublishVolume semantics against EC2 instead of patching
+// Node.status directly, off a VolumeAttachment informer rather than polling.
+type VolumeAttachmentController struct {
+	clientset *kubernetes.Clientset
+	providers map[string]cloudprovider.Provider
+
+	vaLister storagelisters.VolumeAttachmentLister
+	vaSynced cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+}
+
+// NewVolumeAttachmentController wires up a VolumeAttachmentController
+// against the given shared informer. It does not start processing until
+// Run is called.
+func NewVolumeAttachmentController(clientset *kubernetes.Clientset, vaInformer storageinformers.VolumeAttachmentInformer, providers map[string]cloudprovider.Provider) *VolumeAttachmentController {
+	c := &VolumeAttachmentController{
+		clientset: clientset,
+		providers: providers,
+		vaLister:  vaInformer.Lister(),
+		vaSynced:  vaInformer.Informer().HasSynced,
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "volumeattachments"),
+	}
+
+	vaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+	})
+
+	return c
+}
+
+func (c *VolumeAttachmentController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the given number of reconcile workers and blocks until stopCh
+// is closed.
+func (c *VolumeAttachmentController) Run(workers int, stopCh <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.InfoS("Starting volume-attachment controller")
+
+	if !cache.WaitForCacheSync(stopCh, c.vaSynced) {
+		return fmt.Errorf("failed to wait for volumeattachment informer cache to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	klog.InfoS("Shutting down volume-attachment controller")
+	return nil
+}
+
+func (c *VolumeAttachmentController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *VolumeAttachmentController) processNextWorkItem() bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(key.(string)); err != nil {
+		c.queue.AddRateLimited(key)
+		runtime.HandleError(fmt.Errorf("error syncing volumeattachment %q: %w, requeuing", key, err))
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *VolumeAttachmentController) reconcile(name string) error {
+	ctx := context.Background()
+
+	va, err := c.vaLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if va.Spec.Attacher != ebsCSIDriverName {
+		return nil
+	}
+
+	volumeID, err := volumeHandleForAttachment(ctx, c.clientset, va)
+	if err != nil {
+		return fmt.Errorf("resolving volume handle for VolumeAttachment %s: %w", va.Name, err)
+	}
+	if volumeID == "" {
+		return nil
+	}
+
+	node, err := c.clientset.CoreV1().Nodes().Get(ctx, va.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting node %s for VolumeAttachment %s: %w", va.Spec.NodeName, va.Name, err)
+	}
+
+	provider, err := providerFor(c.providers, node)
+	if err != nil {
+		return err
+	}
+
+	if va.DeletionTimestamp != nil {
+		return c.unpublish(ctx, va, provider, volumeID, node)
+	}
+
+	// The finalizer has to be in place before we call ControllerPublishVolume:
+	// otherwise the VolumeAttachment could be deleted by the API server
+	// between the publish call succeeding and us observing it, leaking the
+	// EC2 attachment with nothing left to drive ControllerUnpublishVolume.
+	if err := addAttacherFinalizer(ctx, c.clientset, va); err != nil {
+		return fmt.Errorf("adding finalizer to VolumeAttachment %s: %w", va.Name, err)
+	}
+
+	if va.Status.Attached {
+		return nil
+	}
+
+	inUseDevices, err := devicesInUseOnNode(c.vaLister, node.Name, va.Name)
+	if err != nil {
+		return fmt.Errorf("listing in-use devices on node %s: %w", node.Name, err)
+	}
+
+	devicePath, err := attachEBSVolume(c.clientset, provider, corev1.UniqueVolumeName(volumeID), node, inUseDevices)
+	if err != nil {
+		return fmt.Errorf("publishing volume %s on node %s: %w", volumeID, node.Name, err)
+	}
+	if err := patchVolumeAttachmentStatus(ctx, c.clientset, va, true, devicePath); err != nil {
+		return fmt.Errorf("updating VolumeAttachment %s status: %w", va.Name, err)
+	}
+	klog.InfoS("ControllerPublishVolume succeeded", "volume", volumeID, "node", node.Name, "devicePath", devicePath)
+	return nil
+}
+
+func (c *VolumeAttachmentController) unpublish(ctx context.Context, va *storagev1.VolumeAttachment, provider cloudprovider.Provider, volumeID string, node *corev1.Node) error {
+	if !hasFinalizer(va, ebsAttacherFinalizer) {
+		return nil
+	}
+	if err := detachEBSVolume(provider, corev1.UniqueVolumeName(volumeID), node); err != nil {
+		return fmt.Errorf("unpublishing volume %s on node %s: %w", volumeID, node.Name, err)
+	}
+	klog.InfoS("ControllerUnpublishVolume succeeded", "volume", volumeID, "node", node.Name)
+	return removeAttacherFinalizer(ctx, c.clientset, va)
+}
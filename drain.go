@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// DrainOptions mirrors the knobs `kubectl drain` exposes, so a node removed
+// by this controller disrupts workloads the same way an operator-initiated
+// drain would.
+type DrainOptions struct {
+	// GracePeriod is passed to each pod eviction; <0 uses the pod's own
+	// terminationGracePeriodSeconds.
+	GracePeriod time.Duration
+	// Force evicts pods not backed by a ReplicationController, ReplicaSet,
+	// Job, DaemonSet or StatefulSet.
+	Force bool
+	// DeleteLocalData allows evicting pods that use emptyDir volumes,
+	// discarding that data.
+	DeleteLocalData bool
+	// IgnoreDaemonSets skips pods owned by a DaemonSet instead of failing
+	// the drain on them.
+	IgnoreDaemonSets bool
+	// Timeout bounds how long we wait for a pod to actually terminate
+	// after eviction before giving up (or, for a node whose instance is
+	// confirmed gone, force-deleting it).
+	Timeout time.Duration
+}
+
+func cordonNode(ctx context.Context, clientset *kubernetes.Clientset, node *corev1.Node) error {
+	if node.Spec.Unschedulable {
+		return nil
+	}
+	patch := []byte(`{"spec":{"unschedulable":true}}`)
+	_, err := clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func isMirrorPod(pod *corev1.Pod) bool {
+	_, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]
+	return ok
+}
+
+func isDaemonSetPod(pod *corev1.Pod) bool {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
+
+func isOrphanPod(pod *corev1.Pod) bool {
+	for _, ref := range pod.OwnerReferences {
+		switch ref.Kind {
+		case "ReplicationController", "ReplicaSet", "Job", "DaemonSet", "StatefulSet":
+			return false
+		}
+	}
+	return true
+}
+
+func usesLocalStorage(pod *corev1.Pod) bool {
+	for _, vol := range pod.Spec.Volumes {
+		if vol.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// podsToEvict lists the pods a drain of nodeName needs to evict, applying
+// the same filtering rules `kubectl drain` does: mirror pods are left
+// alone (the kubelet owns them), DaemonSet pods are skipped if
+// IgnoreDaemonSets is set, orphaned pods require Force, and pods with
+// local storage require DeleteLocalData.
+func podsToEvict(ctx context.Context, clientset kubernetes.Interface, nodeName string, opts DrainOptions) ([]corev1.Pod, error) {
+	podList, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make([]corev1.Pod, 0, len(podList.Items))
+	for _, pod := range podList.Items {
+		if isMirrorPod(&pod) {
+			continue
+		}
+		if isDaemonSetPod(&pod) {
+			if !opts.IgnoreDaemonSets {
+				return nil, fmt.Errorf("pod %s/%s is managed by a DaemonSet; pass --ignore-daemonsets to drain past it", pod.Namespace, pod.Name)
+			}
+			continue
+		}
+		if isOrphanPod(&pod) && !opts.Force {
+			return nil, fmt.Errorf("pod %s/%s is not managed by a controller; pass --force to evict it", pod.Namespace, pod.Name)
+		}
+		if usesLocalStorage(&pod) && !opts.DeleteLocalData {
+			return nil, fmt.Errorf("pod %s/%s uses emptyDir storage; pass --delete-local-data to evict it", pod.Namespace, pod.Name)
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func evictPod(ctx context.Context, clientset *kubernetes.Clientset, pod corev1.Pod, gracePeriod time.Duration) error {
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+	if gracePeriod >= 0 {
+		seconds := int64(gracePeriod.Seconds())
+		eviction.DeleteOptions = &metav1.DeleteOptions{GracePeriodSeconds: &seconds}
+	}
+	return clientset.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+}
+
+func forceDeletePod(ctx context.Context, clientset *kubernetes.Clientset, pod corev1.Pod) error {
+	gracePeriod := int64(0)
+	return clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+}
+
+func waitForPodDeletion(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) error {
+	return wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		_, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return false, nil
+	}, ctx.Done())
+}
+
+// evictRetryInterval is how often a PDB-blocked eviction is retried, the
+// same cadence `kubectl drain` polls at while waiting for a disruption
+// budget to allow progress.
+const evictRetryInterval = 5 * time.Second
+
+// evictPodsWithRetry evicts every pod in pods concurrently, retrying a pod
+// whose eviction is blocked by a PodDisruptionBudget (HTTP 429) every
+// evictRetryInterval until it succeeds or ctx's opts.Timeout deadline
+// passes. A single blocked eviction must not stall the others, and it must
+// not push the whole node reconcile onto the controller's node-level
+// exponential backoff, which climbs far past the time a PDB typically
+// takes to free up.
+func evictPodsWithRetry(ctx context.Context, clientset *kubernetes.Clientset, pods []corev1.Pod, opts DrainOptions) error {
+	evictCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod corev1.Pod) {
+			defer wg.Done()
+			err := wait.PollImmediateUntil(evictRetryInterval, func() (bool, error) {
+				err := evictPod(evictCtx, clientset, pod, opts.GracePeriod)
+				switch {
+				case err == nil || apierrors.IsNotFound(err):
+					return true, nil
+				case apierrors.IsTooManyRequests(err):
+					return false, nil
+				default:
+					return false, err
+				}
+			}, evictCtx.Done())
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("evicting pod %s/%s: %w", pod.Namespace, pod.Name, err))
+				mu.Unlock()
+			}
+		}(pod)
+	}
+	wg.Wait()
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// awaitPodsTerminated waits on every pod in pods concurrently against a
+// single opts.Timeout deadline shared across the whole set, rather than
+// opts.Timeout per pod. The backing instance for these pods is confirmed
+// gone by the time this is called, so a dead kubelet will never report
+// their termination; whichever pods are still present once the shared
+// deadline expires are force-deleted with a zero grace period so
+// StatefulSets can reschedule promptly instead of waiting out pods that
+// will never self-report.
+func awaitPodsTerminated(ctx context.Context, clientset *kubernetes.Clientset, node *corev1.Node, pods []corev1.Pod, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod corev1.Pod) {
+			defer wg.Done()
+			if err := waitForPodDeletion(waitCtx, clientset, pod.Namespace, pod.Name); err == nil {
+				return
+			}
+			klog.InfoS("Force-deleting pod stuck on terminated instance", "pod", pod.Namespace+"/"+pod.Name, "node", node.Name)
+			if err := forceDeletePod(ctx, clientset, pod); err != nil && !apierrors.IsNotFound(err) {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("force-deleting pod %s/%s: %w", pod.Namespace, pod.Name, err))
+				mu.Unlock()
+			}
+		}(pod)
+	}
+	wg.Wait()
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// drainAndDeleteNode cordons node, evicts every pod scheduled on it honoring
+// PodDisruptionBudgets, waits for them to actually terminate, and only then
+// deletes the Node object.
+func drainAndDeleteNode(ctx context.Context, clientset *kubernetes.Clientset, node *corev1.Node, opts DrainOptions) error {
+	if err := cordonNode(ctx, clientset, node); err != nil {
+		return fmt.Errorf("cordoning %s: %w", node.Name, err)
+	}
+
+	pods, err := podsToEvict(ctx, clientset, node.Name, opts)
+	if err != nil {
+		return fmt.Errorf("listing pods on %s: %w", node.Name, err)
+	}
+
+	if err := evictPodsWithRetry(ctx, clientset, pods, opts); err != nil {
+		return err
+	}
+
+	if err := awaitPodsTerminated(ctx, clientset, node, pods, opts.Timeout); err != nil {
+		return err
+	}
+
+	return clientset.CoreV1().Nodes().Delete(ctx, node.Name, metav1.DeleteOptions{})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func podOwnedBy(kind, namespace, name string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			OwnerReferences: []metav1.OwnerReference{{Kind: kind}},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1"},
+	}
+}
+
+func TestPodsToEvict(t *testing.T) {
+	mirror := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "kube-system",
+			Name:        "mirror",
+			Annotations: map[string]string{corev1.MirrorPodAnnotationKey: ""},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1"},
+	}
+	daemonset := podOwnedBy("DaemonSet", "kube-system", "ds-pod")
+	replicaSet := podOwnedBy("ReplicaSet", "default", "rs-pod")
+	orphan := podOwnedBy("", "default", "orphan-pod")
+	emptyDirPod := podOwnedBy("ReplicaSet", "default", "emptydir-pod")
+	emptyDirPod.Spec.Volumes = []corev1.Volume{{Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+
+	cases := []struct {
+		name    string
+		pods    []corev1.Pod
+		opts    DrainOptions
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "mirror pods are always skipped",
+			pods: []corev1.Pod{mirror, replicaSet},
+			opts: DrainOptions{},
+			want: []string{"rs-pod"},
+		},
+		{
+			name:    "daemonset pod without IgnoreDaemonSets fails the drain",
+			pods:    []corev1.Pod{daemonset},
+			opts:    DrainOptions{},
+			wantErr: true,
+		},
+		{
+			name: "daemonset pod with IgnoreDaemonSets is skipped",
+			pods: []corev1.Pod{daemonset, replicaSet},
+			opts: DrainOptions{IgnoreDaemonSets: true},
+			want: []string{"rs-pod"},
+		},
+		{
+			name:    "orphan pod without Force fails the drain",
+			pods:    []corev1.Pod{orphan},
+			opts:    DrainOptions{},
+			wantErr: true,
+		},
+		{
+			name: "orphan pod with Force is evicted",
+			pods: []corev1.Pod{orphan},
+			opts: DrainOptions{Force: true},
+			want: []string{"orphan-pod"},
+		},
+		{
+			name:    "emptyDir pod without DeleteLocalData fails the drain",
+			pods:    []corev1.Pod{emptyDirPod},
+			opts:    DrainOptions{},
+			wantErr: true,
+		},
+		{
+			name: "emptyDir pod with DeleteLocalData is evicted",
+			pods: []corev1.Pod{emptyDirPod},
+			opts: DrainOptions{DeleteLocalData: true},
+			want: []string{"emptydir-pod"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := make([]runtime.Object, len(tc.pods))
+			for i := range tc.pods {
+				pod := tc.pods[i]
+				objs[i] = &pod
+			}
+			clientset := fake.NewSimpleClientset(objs...)
+
+			got, err := podsToEvict(context.Background(), clientset, "node-1", tc.opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("podsToEvict(): expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("podsToEvict(): unexpected error: %v", err)
+			}
+			names := make([]string, len(got))
+			for i, pod := range got {
+				names[i] = pod.Name
+			}
+			if !equalStringSlices(names, tc.want) {
+				t.Errorf("podsToEvict() = %v, want %v", names, tc.want)
+			}
+		})
+	}
+}
+
+func equalStringSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -4,19 +4,49 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	types "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider"
+	"github.com/monder/aws-node-cleanup/internal/metrics"
 )
 
+// emitMultiAttachWarning records a Kubernetes Event on the node making clear
+// that EBS Multi-Attach gives no filesystem-level fencing: it is up to the
+// application to avoid corrupting data when a volume is writable from more
+// than one instance at once.
+func emitMultiAttachWarning(ctx context.Context, clientset *kubernetes.Clientset, node *corev1.Node, volumeID string) {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "ebs-multi-attach-",
+			Namespace:    "default",
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Node",
+			Name: node.Name,
+			UID:  node.UID,
+		},
+		Reason:         "EBSMultiAttach",
+		Message:        fmt.Sprintf("Volume %s is being attached to node %s while already attached elsewhere; application-level I/O fencing is required", volumeID, node.Name),
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "aws-node-cleanup"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := clientset.CoreV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		region, instanceID := cloudprovider.LogFields(node.Spec.ProviderID)
+		klog.ErrorS(err, "Unable to emit multi-attach warning event", "volumeID", volumeID, "node", node.Name, "instanceID", instanceID, "region", region)
+	}
+}
+
 func volumeInUse(volumeName corev1.UniqueVolumeName, node *corev1.Node) bool {
 	for _, name := range node.Status.VolumesInUse {
 		if name == volumeName {
@@ -26,9 +56,9 @@ func volumeInUse(volumeName corev1.UniqueVolumeName, node *corev1.Node) bool {
 	return false
 }
 
-func deviceNameInUse(dev string, node *corev1.Node) bool {
-	for _, volume := range node.Status.VolumesAttached {
-		if volume.DevicePath == dev {
+func deviceNameInUse(dev string, inUseDevices []string) bool {
+	for _, used := range inUseDevices {
+		if used == dev {
 			return true
 		}
 	}
@@ -44,11 +74,27 @@ func volumeAttached(volumeName corev1.UniqueVolumeName, node *corev1.Node) bool
 	return false
 }
 
-func freeDeviceName(node *corev1.Node) (string, error) {
+// attachedDevicePaths lists the device paths node.Status.VolumesAttached
+// already claims. It only reflects volumes attached through the legacy
+// in-tree path, which is the only path that writes to that field; see
+// devicesInUseOnNode for the CSI external-attacher equivalent.
+func attachedDevicePaths(node *corev1.Node) []string {
+	devices := make([]string, 0, len(node.Status.VolumesAttached))
+	for _, volume := range node.Status.VolumesAttached {
+		devices = append(devices, volume.DevicePath)
+	}
+	return devices
+}
+
+// freeDeviceName picks the first device path not present in inUseDevices,
+// which the caller is responsible for sourcing from whatever actually
+// tracks attachments on the path it's driving (Node.status.volumesAttached
+// for the legacy in-tree path, VolumeAttachment status for the CSI path).
+func freeDeviceName(inUseDevices []string) (string, error) {
 	for _, firstChar := range []rune{'b', 'c'} {
 		for i := 'a'; i <= 'z'; i++ {
 			dev := "/dev/xvd" + string([]rune{firstChar, i})
-			if !deviceNameInUse(dev, node) {
+			if !deviceNameInUse(dev, inUseDevices) {
 				return dev, nil
 			}
 		}
@@ -56,94 +102,57 @@ func freeDeviceName(node *corev1.Node) (string, error) {
 	return "", fmt.Errorf("all device names are in use")
 }
 
-func attachEBSVolume(volumeName corev1.UniqueVolumeName, node *corev1.Node) (string, error) {
-	providerID := node.Spec.ProviderID
-	parsedProviderID := strings.Split(providerID, "/")
-	parsedVolumeID := strings.Split(string(volumeName), "/")
+func providerFor(providers map[string]cloudprovider.Provider, node *corev1.Node) (cloudprovider.Provider, error) {
+	provider, ok := providers[cloudprovider.Scheme(node.Spec.ProviderID)]
+	if !ok {
+		return nil, fmt.Errorf("no cloud provider registered for node %s (providerID %q)", node.Name, node.Spec.ProviderID)
+	}
+	return provider, nil
+}
 
-	region := node.Labels["failure-domain.beta.kubernetes.io/region"]
-	instanceID := parsedProviderID[len(parsedProviderID)-1]
+func attachEBSVolume(clientset *kubernetes.Clientset, provider cloudprovider.Provider, volumeName corev1.UniqueVolumeName, node *corev1.Node, inUseDevices []string) (string, error) {
+	parsedVolumeID := strings.Split(string(volumeName), "/")
 	volumeID := parsedVolumeID[len(parsedVolumeID)-1]
 
-	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})))
-
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	res, err := svc.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
-		VolumeIds: []*string{
-			aws.String(volumeID),
-		},
-	})
+	deviceName, err := freeDeviceName(inUseDevices)
 	if err != nil {
 		return "", err
 	}
-	if len(res.Volumes) == 1 &&
-		len(res.Volumes[0].Attachments) == 1 && res.Volumes[0].Attachments[0].InstanceId != nil &&
-		res.Volumes[0].Attachments[0].Device != nil &&
-		*res.Volumes[0].Attachments[0].InstanceId == instanceID {
 
-		log.Printf("Volume %s is already attached\n", volumeName)
-		return *res.Volumes[0].Attachments[0].Device, nil
-	}
-	deviceName, err := freeDeviceName(node)
+	var devicePath string
+	var multiAttach bool
+	err = metrics.TimeCloudCall("attach", func() error {
+		var attachErr error
+		devicePath, multiAttach, attachErr = provider.AttachVolume(ctx, volumeID, node.Spec.ProviderID, deviceName)
+		return attachErr
+	})
 	if err != nil {
 		return "", err
 	}
-	_, err = svc.AttachVolumeWithContext(ctx, &ec2.AttachVolumeInput{
-		InstanceId: aws.String(instanceID),
-		VolumeId:   aws.String(volumeID),
-		Device:     aws.String(deviceName),
-	})
-	return deviceName, err
+	if multiAttach {
+		emitMultiAttachWarning(ctx, clientset, node, volumeID)
+	}
+	region, instanceID := cloudprovider.LogFields(node.Spec.ProviderID)
+	klog.InfoS("Volume attached", "volume", volumeName, "node", node.Name, "devicePath", devicePath, "instanceID", instanceID, "region", region)
+	return devicePath, nil
 }
 
-func detachEBSVolume(volumeName corev1.UniqueVolumeName, node *corev1.Node) error {
-	providerID := node.Spec.ProviderID
-	parsedProviderID := strings.Split(providerID, "/")
+func detachEBSVolume(provider cloudprovider.Provider, volumeName corev1.UniqueVolumeName, node *corev1.Node) error {
 	parsedVolumeID := strings.Split(string(volumeName), "/")
-
-	region := node.Labels["failure-domain.beta.kubernetes.io/region"]
-	instanceID := parsedProviderID[len(parsedProviderID)-1]
 	volumeID := parsedVolumeID[len(parsedVolumeID)-1]
 
-	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})))
-
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	res, err := svc.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
-		VolumeIds: []*string{
-			aws.String(volumeID),
-		},
-	})
-	if err != nil {
-		return err
-	}
-	if len(res.Volumes) == 1 && res.Volumes[0].State != nil && *res.Volumes[0].State == "available" {
-		log.Printf("Volume %s is already detached\n", volumeName)
-		return nil
-	}
-	if len(res.Volumes) == 1 &&
-		len(res.Volumes[0].Attachments) == 1 && res.Volumes[0].Attachments[0].InstanceId != nil &&
-		res.Volumes[0].Attachments[0].Device != nil &&
-		*res.Volumes[0].Attachments[0].InstanceId != instanceID {
-
-		log.Printf("Volume %s is attached to other instance\n", volumeName)
-		return nil
-	}
-	_, err = svc.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
-		InstanceId: aws.String(instanceID),
-		VolumeId:   aws.String(volumeID),
+	return metrics.TimeCloudCall("detach", func() error {
+		return provider.DetachVolume(ctx, volumeID, node.Spec.ProviderID)
 	})
-	return err
 }
 
-func addVolumeToNode(clientset *kubernetes.Clientset, volumeName corev1.UniqueVolumeName, deviceName string, node *corev1.Node) error {
+func addVolumeToNode(ctx context.Context, clientset *kubernetes.Clientset, volumeName corev1.UniqueVolumeName, deviceName string, node *corev1.Node) error {
 	patchData, err := json.Marshal([]map[string]interface{}{
 		map[string]interface{}{
 			"op":   "replace",
@@ -157,15 +166,15 @@ func addVolumeToNode(clientset *kubernetes.Clientset, volumeName corev1.UniqueVo
 	if err != nil {
 		return err
 	}
-	ns, err := clientset.CoreV1().Nodes().Patch(node.Name, types.JSONPatchType, patchData, "status")
+	ns, err := clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.JSONPatchType, patchData, metav1.PatchOptions{}, "status")
 	if err != nil {
 		return err
 	}
-	log.Printf("Adding volume %s for node %s succeeded. VolumesAttached: %v\n", volumeName, node.Name, ns.Status.VolumesAttached)
+	klog.InfoS("Added volume to node status", "volume", volumeName, "node", node.Name, "volumesAttached", ns.Status.VolumesAttached)
 	return nil
 }
 
-func removeVolumeFromNode(clientset *kubernetes.Clientset, volumeName corev1.UniqueVolumeName, node *corev1.Node) error {
+func removeVolumeFromNode(ctx context.Context, clientset *kubernetes.Clientset, volumeName corev1.UniqueVolumeName, node *corev1.Node) error {
 	newAttachedVolumes := make([]corev1.AttachedVolume, 0)
 	for _, v := range node.Status.VolumesAttached {
 		if v.Name != volumeName {
@@ -182,38 +191,44 @@ func removeVolumeFromNode(clientset *kubernetes.Clientset, volumeName corev1.Uni
 	if err != nil {
 		return err
 	}
-	ns, err := clientset.CoreV1().Nodes().Patch(node.Name, types.JSONPatchType, patchData, "status")
+	ns, err := clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.JSONPatchType, patchData, metav1.PatchOptions{}, "status")
 	if err != nil {
 		return err
 	}
-	log.Printf("Removing volume %s from node %s succeeded. VolumesAttached: %v\n", volumeName, node.Name, ns.Status.VolumesAttached)
+	klog.InfoS("Removed volume from node status", "volume", volumeName, "node", node.Name, "volumesAttached", ns.Status.VolumesAttached)
 	return nil
 }
 
-func mountPendingEBSVolumes(clientset *kubernetes.Clientset) {
-	nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+func mountPendingEBSVolumes(ctx context.Context, clientset *kubernetes.Clientset, providers map[string]cloudprovider.Provider) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		panic(err.Error())
 	}
 
-	log.Printf("running\n")
+	klog.V(1).InfoS("Reconciling pending EBS volume attachments")
 	// First detach volumes we dont need
 	for _, node := range nodes.Items {
 		if node.Annotations["volumes.kubernetes.io/controller-managed-attach-detach"] != "true" {
 			continue
 		}
+		provider, err := providerFor(providers, &node)
+		if err != nil {
+			klog.ErrorS(err, "Resolving cloud provider", "node", node.Name)
+			continue
+		}
 		// TODO fix stuck when no pods were scheduled
 		for _, attachedVolume := range node.Status.VolumesAttached {
 			if strings.HasPrefix(string(attachedVolume.Name), "kubernetes.io/aws-ebs/") && !volumeInUse(attachedVolume.Name, &node) {
-				log.Printf("Need to detach volume %s from %s\n", attachedVolume.Name, node.Name)
-				err := detachEBSVolume(attachedVolume.Name, &node)
+				region, instanceID := cloudprovider.LogFields(node.Spec.ProviderID)
+				klog.InfoS("Detaching volume no longer in use", "volume", attachedVolume.Name, "node", node.Name, "instanceID", instanceID, "region", region)
+				err := detachEBSVolume(provider, attachedVolume.Name, &node)
 				if err != nil {
-					log.Printf("Unable to detach EBS: %s", err.Error())
+					klog.ErrorS(err, "Unable to detach EBS volume", "volume", attachedVolume.Name, "node", node.Name, "instanceID", instanceID, "region", region)
 					continue
 				}
-				err = removeVolumeFromNode(clientset, attachedVolume.Name, &node)
+				err = removeVolumeFromNode(ctx, clientset, attachedVolume.Name, &node)
 				if err != nil {
-					log.Printf("Unable to sync EBS status: %s", err.Error())
+					klog.ErrorS(err, "Unable to sync EBS status", "volume", attachedVolume.Name, "node", node.Name)
 					continue
 				}
 			}
@@ -225,17 +240,23 @@ func mountPendingEBSVolumes(clientset *kubernetes.Clientset) {
 		if node.Annotations["volumes.kubernetes.io/controller-managed-attach-detach"] != "true" {
 			continue
 		}
+		provider, err := providerFor(providers, &node)
+		if err != nil {
+			klog.ErrorS(err, "Resolving cloud provider", "node", node.Name)
+			continue
+		}
 		for _, requiredVolume := range node.Status.VolumesInUse {
 			if strings.HasPrefix(string(requiredVolume), "kubernetes.io/aws-ebs/") && !volumeAttached(requiredVolume, &node) {
-				log.Printf("Need to attach volume %s to %s\n", requiredVolume, node.Name)
-				device, err := attachEBSVolume(requiredVolume, &node)
+				region, instanceID := cloudprovider.LogFields(node.Spec.ProviderID)
+				klog.InfoS("Attaching required volume", "volume", requiredVolume, "node", node.Name, "instanceID", instanceID, "region", region)
+				device, err := attachEBSVolume(clientset, provider, requiredVolume, &node, attachedDevicePaths(&node))
 				if err != nil {
-					log.Printf("Unable to attach EBS: %s", err.Error())
+					klog.ErrorS(err, "Unable to attach EBS volume", "volume", requiredVolume, "node", node.Name, "instanceID", instanceID, "region", region)
 					continue
 				}
-				err = addVolumeToNode(clientset, requiredVolume, device, &node)
+				err = addVolumeToNode(ctx, clientset, requiredVolume, device, &node)
 				if err != nil {
-					log.Printf("Unable to sync EBS status: %s", err.Error())
+					klog.ErrorS(err, "Unable to sync EBS status", "volume", requiredVolume, "node", node.Name)
 					continue
 				}
 			}
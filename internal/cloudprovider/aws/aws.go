@@ -0,0 +1,382 @@
+// Package aws implements cloudprovider.Provider against EC2, for Nodes
+// whose spec.providerID starts with "aws://".
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/time/rate"
+
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider"
+	"github.com/monder/aws-node-cleanup/internal/metrics"
+)
+
+// instanceBatchWindow is how long InstanceExists waits for other concurrent
+// callers in the same region before issuing a single batched
+// DescribeInstances call on their behalf.
+const instanceBatchWindow = 200 * time.Millisecond
+
+// Config tunes how hard the provider is allowed to hit the EC2 API.
+type Config struct {
+	// QPS and Burst bound the token-bucket rate limiter shared by every EC2
+	// call this provider makes, across all regions. Zero values fall back
+	// to defaults generous enough for a small cluster but safe for a large
+	// one: 10 requests/second, bursting to 20.
+	QPS   float64
+	Burst int
+}
+
+// Provider implements cloudprovider.Provider against EC2. It caches one
+// *ec2.EC2 client per region and rate-limits every call it makes, and
+// coalesces concurrent InstanceExists lookups into batched DescribeInstances
+// calls instead of issuing one API call per instance.
+type Provider struct {
+	limiter *rate.Limiter
+
+	clientsMu sync.Mutex
+	clients   map[string]*ec2.EC2
+
+	batchesMu sync.Mutex
+	batches   map[string]*instanceBatch
+}
+
+// New returns an EC2-backed cloudprovider.Provider.
+func New(cfg Config) *Provider {
+	qps := cfg.QPS
+	if qps <= 0 {
+		qps = 10
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = 20
+	}
+	return &Provider{
+		limiter: rate.NewLimiter(rate.Limit(qps), burst),
+		clients: make(map[string]*ec2.EC2),
+		batches: make(map[string]*instanceBatch),
+	}
+}
+
+func (p *Provider) ec2For(region string) *ec2.EC2 {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	if svc, ok := p.clients[region]; ok {
+		return svc
+	}
+	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})))
+	p.clients[region] = svc
+	return svc
+}
+
+func (p *Provider) wait(ctx context.Context) error {
+	return p.limiter.Wait(ctx)
+}
+
+// parseProviderID splits an "aws:///<az>/<instance-id>" providerID into the
+// availability zone and region the instance runs in, and its instance ID.
+func parseProviderID(providerID string) (region, az, instanceID string, err error) {
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(providerID, "aws://"), "/")
+	parts := strings.Split(trimmed, "/")
+	instanceID = parts[len(parts)-1]
+	if len(parts) < 2 || len(parts[len(parts)-2]) < 2 {
+		return "", "", "", fmt.Errorf("could not determine AWS region from providerID %q", providerID)
+	}
+	az = parts[len(parts)-2]
+	return az[:len(az)-1], az, instanceID, nil
+}
+
+func providerIDFor(az, instanceID string) string {
+	return fmt.Sprintf("aws:///%s/%s", az, instanceID)
+}
+
+// instanceBatch accumulates InstanceExists lookups for a single region so
+// they can be served by one DescribeInstances call instead of one per node.
+type instanceBatch struct {
+	waiters map[string][]chan instanceResult
+}
+
+type instanceResult struct {
+	exists bool
+	err    error
+}
+
+func (p *Provider) InstanceExists(ctx context.Context, providerID string) (bool, error) {
+	region, _, instanceID, err := parseProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+
+	resultCh := make(chan instanceResult, 1)
+	p.batchesMu.Lock()
+	b, ok := p.batches[region]
+	if !ok {
+		b = &instanceBatch{waiters: make(map[string][]chan instanceResult)}
+		p.batches[region] = b
+		time.AfterFunc(instanceBatchWindow, func() { p.flushInstanceBatch(region) })
+	}
+	b.waiters[instanceID] = append(b.waiters[instanceID], resultCh)
+	p.batchesMu.Unlock()
+
+	select {
+	case res := <-resultCh:
+		return res.exists, res.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (p *Provider) flushInstanceBatch(region string) {
+	p.batchesMu.Lock()
+	b, ok := p.batches[region]
+	if ok {
+		delete(p.batches, region)
+	}
+	p.batchesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	ids := make([]string, 0, len(b.waiters))
+	for id := range b.waiters {
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	states, err := p.describeInstanceStates(ctx, region, ids)
+
+	for id, waiters := range b.waiters {
+		res := instanceResult{err: err}
+		if err == nil {
+			res.exists = states[id]
+		}
+		for _, ch := range waiters {
+			ch <- res
+			close(ch)
+		}
+	}
+}
+
+// describeInstanceStates batches and paginates a DescribeInstances call
+// across every id in one region. It filters on instance-id rather than
+// passing InstanceIds, since AWS fails the whole request with
+// InvalidInstanceID.NotFound for an InstanceIds list containing even one
+// stale ID but silently omits unmatched IDs from a filter - which is also
+// exactly the "instance is gone" signal we want, alongside an explicit
+// terminated/shutting-down state for instances EC2 hasn't purged yet.
+func (p *Provider) describeInstanceStates(ctx context.Context, region string, ids []string) (map[string]bool, error) {
+	svc := p.ec2For(region)
+
+	states := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		states[id] = false
+	}
+
+	idPtrs := make([]*string, len(ids))
+	for i, id := range ids {
+		idPtrs[i] = aws.String(id)
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("instance-id"), Values: idPtrs}},
+	}
+
+	if err := p.wait(ctx); err != nil {
+		return nil, err
+	}
+	err := metrics.TimeCloudCall("describe-instances", func() error {
+		return svc.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					exists := true
+					if instance.State != nil {
+						switch aws.StringValue(instance.State.Name) {
+						case ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown:
+							exists = false
+						}
+					}
+					states[aws.StringValue(instance.InstanceId)] = exists
+				}
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (p *Provider) DescribeAttachment(ctx context.Context, volumeID string) ([]cloudprovider.Attachment, error) {
+	region, err := p.regionOfVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := p.describeVolume(ctx, region, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make([]cloudprovider.Attachment, 0, len(vol.Attachments))
+	for _, a := range vol.Attachments {
+		if a.InstanceId == nil || a.Device == nil {
+			continue
+		}
+		attachments = append(attachments, cloudprovider.Attachment{
+			InstanceID: providerIDFor(aws.StringValue(vol.AvailabilityZone), *a.InstanceId),
+			DevicePath: *a.Device,
+		})
+	}
+	return attachments, nil
+}
+
+// regionOfVolume is used by DescribeAttachment, which only gets a bare
+// volumeID and so can't recover a region from a providerID the way the
+// other methods do. EBS volume IDs don't encode region, so we fall back to
+// scanning every region the default credential chain has access to; in
+// practice callers nearly always already know the region because they're
+// acting on a specific Node, so this path is rarely hit.
+func (p *Provider) regionOfVolume(ctx context.Context, volumeID string) (string, error) {
+	if err := p.wait(ctx); err != nil {
+		return "", err
+	}
+	svc := p.ec2For("us-east-1")
+	var regions *ec2.DescribeRegionsOutput
+	err := metrics.TimeCloudCall("describe-regions", func() error {
+		var err error
+		regions, err = svc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, r := range regions.Regions {
+		region := aws.StringValue(r.RegionName)
+		if _, err := p.describeVolume(ctx, region, volumeID); err == nil {
+			return region, nil
+		}
+	}
+	return "", fmt.Errorf("volume %s not found in any region", volumeID)
+}
+
+func (p *Provider) describeVolume(ctx context.Context, region, volumeID string) (*ec2.Volume, error) {
+	if err := p.wait(ctx); err != nil {
+		return nil, err
+	}
+	var res *ec2.DescribeVolumesOutput
+	err := metrics.TimeCloudCall("describe-volumes", func() error {
+		var err error
+		res, err = p.ec2For(region).DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Volumes) != 1 {
+		return nil, fmt.Errorf("expected exactly one volume %s, found %d", volumeID, len(res.Volumes))
+	}
+	return res.Volumes[0], nil
+}
+
+// isMultiAttachVolume reports whether an EBS volume is eligible to be
+// attached to more than one instance at a time: io1/io2 with Multi-Attach
+// explicitly enabled.
+func isMultiAttachVolume(vol *ec2.Volume) bool {
+	if vol.VolumeType == nil {
+		return false
+	}
+	switch *vol.VolumeType {
+	case ec2.VolumeTypeIo1, ec2.VolumeTypeIo2:
+		return aws.BoolValue(vol.MultiAttachEnabled)
+	default:
+		return false
+	}
+}
+
+func (p *Provider) AttachVolume(ctx context.Context, volumeID, providerID, device string) (string, bool, error) {
+	region, az, instanceID, err := parseProviderID(providerID)
+	if err != nil {
+		return "", false, err
+	}
+
+	vol, err := p.describeVolume(ctx, region, volumeID)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, a := range vol.Attachments {
+		if a.InstanceId != nil && a.Device != nil && *a.InstanceId == instanceID {
+			return *a.Device, len(vol.Attachments) > 1, nil
+		}
+	}
+
+	if len(vol.Attachments) > 0 {
+		if !isMultiAttachVolume(vol) {
+			return "", false, fmt.Errorf("volume %s is already attached to another instance and is not Multi-Attach enabled", volumeID)
+		}
+		if az != aws.StringValue(vol.AvailabilityZone) {
+			return "", false, fmt.Errorf("volume %s is Multi-Attach but lives in %s, not instance %s's zone %s", volumeID, aws.StringValue(vol.AvailabilityZone), instanceID, az)
+		}
+	}
+
+	if err := p.wait(ctx); err != nil {
+		return "", false, err
+	}
+	err = metrics.TimeCloudCall("attach-volume", func() error {
+		_, err := p.ec2For(region).AttachVolumeWithContext(ctx, &ec2.AttachVolumeInput{
+			InstanceId: aws.String(instanceID),
+			VolumeId:   aws.String(volumeID),
+			Device:     aws.String(device),
+		})
+		return err
+	})
+	return device, len(vol.Attachments) > 0, err
+}
+
+func (p *Provider) DetachVolume(ctx context.Context, volumeID, providerID string) error {
+	region, _, instanceID, err := parseProviderID(providerID)
+	if err != nil {
+		return err
+	}
+
+	vol, err := p.describeVolume(ctx, region, volumeID)
+	if err != nil {
+		return err
+	}
+	if vol.State != nil && *vol.State == ec2.VolumeStateAvailable {
+		return nil
+	}
+
+	attachedHere := false
+	for _, a := range vol.Attachments {
+		if a.InstanceId != nil && *a.InstanceId == instanceID {
+			attachedHere = true
+		}
+	}
+	if !attachedHere {
+		return nil
+	}
+
+	if err := p.wait(ctx); err != nil {
+		return err
+	}
+	return metrics.TimeCloudCall("detach-volume", func() error {
+		_, err := p.ec2For(region).DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+			InstanceId: aws.String(instanceID),
+			VolumeId:   aws.String(volumeID),
+		})
+		return err
+	})
+}
@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseProviderID(t *testing.T) {
+	cases := []struct {
+		name       string
+		providerID string
+		region     string
+		az         string
+		instanceID string
+		wantErr    bool
+	}{
+		{
+			name:       "well formed",
+			providerID: "aws:///us-east-1a/i-0123456789abcdef0",
+			region:     "us-east-1",
+			az:         "us-east-1a",
+			instanceID: "i-0123456789abcdef0",
+		},
+		{
+			name:       "no availability zone",
+			providerID: "aws:///i-0123456789abcdef0",
+			wantErr:    true,
+		},
+		{
+			name:       "missing scheme separator entirely",
+			providerID: "i-0123456789abcdef0",
+			wantErr:    true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			region, az, instanceID, err := parseProviderID(tc.providerID)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseProviderID(%q): expected an error, got none", tc.providerID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseProviderID(%q): unexpected error: %v", tc.providerID, err)
+			}
+			if region != tc.region || az != tc.az || instanceID != tc.instanceID {
+				t.Errorf("parseProviderID(%q) = (%q, %q, %q), want (%q, %q, %q)",
+					tc.providerID, region, az, instanceID, tc.region, tc.az, tc.instanceID)
+			}
+		})
+	}
+}
+
+func TestIsMultiAttachVolume(t *testing.T) {
+	cases := []struct {
+		name string
+		vol  *ec2.Volume
+		want bool
+	}{
+		{
+			name: "io2 with multi-attach enabled",
+			vol:  &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeIo2), MultiAttachEnabled: aws.Bool(true)},
+			want: true,
+		},
+		{
+			name: "io1 with multi-attach enabled",
+			vol:  &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeIo1), MultiAttachEnabled: aws.Bool(true)},
+			want: true,
+		},
+		{
+			name: "io2 without multi-attach enabled",
+			vol:  &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeIo2), MultiAttachEnabled: aws.Bool(false)},
+			want: false,
+		},
+		{
+			name: "gp3 ignores multi-attach flag",
+			vol:  &ec2.Volume{VolumeType: aws.String(ec2.VolumeTypeGp3), MultiAttachEnabled: aws.Bool(true)},
+			want: false,
+		},
+		{
+			name: "no volume type",
+			vol:  &ec2.Volume{},
+			want: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isMultiAttachVolume(tc.vol); got != tc.want {
+				t.Errorf("isMultiAttachVolume() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Package kubevirt implements cloudprovider.Provider against an
+// infrastructure cluster running KubeVirt, for tenant clusters hosted as
+// VirtualMachineInstances (the same model used by the kubevirt CSI
+// driver). Nodes are matched to VMIs by name within a configured namespace,
+// since a KubeVirt providerID carries no AWS-style region or AZ. The
+// configured label selector only scopes the VMI listing in
+// DescribeAttachment; lookups of a single VMI by name do not apply it.
+package kubevirt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"kubevirt.io/client-go/kubecli"
+
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider"
+)
+
+// Config configures the KubeVirt provider: where the infra cluster that
+// hosts the tenant VMs lives, and which VMIs belong to this tenant.
+type Config struct {
+	// InfraKubeconfig points at the infra cluster's kubeconfig. Empty uses
+	// in-cluster config, for when aws-node-cleanup itself runs in-infra.
+	InfraKubeconfig string
+	Namespace       string
+	LabelSelector   string
+}
+
+// Provider implements cloudprovider.Provider against KubeVirt
+// VirtualMachineInstances in an infra cluster.
+type Provider struct {
+	client    kubecli.KubevirtClient
+	namespace string
+	selector  string
+}
+
+// New builds a KubeVirt-backed cloudprovider.Provider from cfg.
+func New(cfg Config) (*Provider, error) {
+	clientConfig, err := clientcmd.BuildConfigFromFlags("", cfg.InfraKubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("loading infra kubeconfig: %w", err)
+	}
+	client, err := kubecli.GetKubevirtClientFromRESTConfig(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("building kubevirt client: %w", err)
+	}
+	return &Provider{client: client, namespace: cfg.Namespace, selector: cfg.LabelSelector}, nil
+}
+
+// vmiName extracts the VMI name from a "kubevirt://<name>" providerID.
+func vmiName(providerID string) string {
+	return strings.TrimPrefix(providerID, "kubevirt://")
+}
+
+// vmi looks up the VirtualMachineInstance backing providerID. The kubevirt
+// client here predates contextual cancellation, so callers that hold a ctx
+// (to satisfy cloudprovider.Provider) cannot actually propagate it.
+func (p *Provider) vmi(providerID string) (*kubevirtv1.VirtualMachineInstance, error) {
+	return p.client.VirtualMachineInstance(p.namespace).Get(vmiName(providerID), &metav1.GetOptions{})
+}
+
+func (p *Provider) InstanceExists(ctx context.Context, providerID string) (bool, error) {
+	_, err := p.vmi(providerID)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// AttachVolume hotplugs volumeID into the VMI. device is not passed to
+// KubeVirt, which picks the disk target itself, and is returned unchanged.
+func (p *Provider) AttachVolume(ctx context.Context, volumeID, providerID, device string) (string, bool, error) {
+	vmi, err := p.vmi(providerID)
+	if err != nil {
+		return "", false, err
+	}
+	for _, v := range vmi.Status.VolumeStatus {
+		if v.Name == volumeID {
+			return device, false, nil
+		}
+	}
+	if err := p.client.VirtualMachineInstance(p.namespace).AddVolume(vmi.Name, &kubevirtv1.AddVolumeOptions{
+		Name: volumeID,
+		VolumeSource: &kubevirtv1.HotplugVolumeSource{
+			PersistentVolumeClaim: &kubevirtv1.PersistentVolumeClaimVolumeSource{
+				PersistentVolumeClaimVolumeSource: corev1.PersistentVolumeClaimVolumeSource{ClaimName: volumeID},
+			},
+		},
+	}); err != nil {
+		return "", false, err
+	}
+	// KubeVirt does not support Multi-Attach semantics today.
+	return device, false, nil
+}
+
+func (p *Provider) DetachVolume(ctx context.Context, volumeID, providerID string) error {
+	vmi, err := p.vmi(providerID)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return p.client.VirtualMachineInstance(p.namespace).RemoveVolume(vmi.Name, &kubevirtv1.RemoveVolumeOptions{
+		Name: volumeID,
+	})
+}
+
+func (p *Provider) DescribeAttachment(ctx context.Context, volumeID string) ([]cloudprovider.Attachment, error) {
+	vmis, err := p.client.VirtualMachineInstance(p.namespace).List(&metav1.ListOptions{LabelSelector: p.selector})
+	if err != nil {
+		return nil, err
+	}
+	var attachments []cloudprovider.Attachment
+	for _, vmi := range vmis.Items {
+		for _, v := range vmi.Status.VolumeStatus {
+			if v.Name == volumeID {
+				attachments = append(attachments, cloudprovider.Attachment{
+					InstanceID: "kubevirt://" + vmi.Name,
+					DevicePath: v.Target,
+				})
+			}
+		}
+	}
+	return attachments, nil
+}
+
+func isNotFound(err error) bool {
+	return apierrors.IsNotFound(err)
+}
@@ -0,0 +1,74 @@
+// Package cloudprovider abstracts the node-lifecycle and volume
+// attach/detach operations aws-node-cleanup needs across infrastructure
+// backends. A Provider is selected per Node from the scheme of its
+// spec.providerID (e.g. "aws", "kubevirt").
+package cloudprovider
+
+import (
+	"context"
+	"strings"
+)
+
+// Attachment describes one instance a volume is currently attached to.
+// InstanceID is the providerID (e.g. "aws:///us-east-1a/i-0123456789abcdef0")
+// of the Node it's attached to, so callers never need to know how a given
+// provider encodes instance identity.
+type Attachment struct {
+	InstanceID string
+	DevicePath string
+}
+
+// Provider implements the cloud-specific operations needed to clean up
+// dead nodes and keep volumes attached to the right instance.
+type Provider interface {
+	// InstanceExists reports whether the instance backing providerID is
+	// still present, in any state other than terminated, shutting down or
+	// not found.
+	InstanceExists(ctx context.Context, providerID string) (bool, error)
+
+	// AttachVolume attaches volumeID to the instance backing providerID at
+	// the given device and returns the device path it ends up attached
+	// at. multiAttach reports whether the volume is now attached to more
+	// than one instance at once, so callers can surface a warning.
+	AttachVolume(ctx context.Context, volumeID, providerID, device string) (devicePath string, multiAttach bool, err error)
+
+	// DetachVolume detaches volumeID from the instance backing providerID.
+	// It is a no-op if the volume isn't attached there.
+	DetachVolume(ctx context.Context, volumeID, providerID string) error
+
+	// DescribeAttachment returns every instance volumeID is currently
+	// attached to.
+	DescribeAttachment(ctx context.Context, volumeID string) ([]Attachment, error)
+}
+
+// Scheme returns the providerID scheme used to select a Provider, e.g.
+// "aws" for "aws:///us-east-1a/i-0123456789abcdef0". It returns "" if
+// providerID has no scheme.
+func Scheme(providerID string) string {
+	if i := strings.Index(providerID, "://"); i >= 0 {
+		return providerID[:i]
+	}
+	return ""
+}
+
+// LogFields best-effort splits a providerID into the region and instance
+// ID components callers want on log lines, without needing to know which
+// Provider owns it. It understands the "<scheme>:///<az>/<id>" shape AWS
+// uses; for providerIDs that carry no region, such as KubeVirt's
+// "kubevirt://<name>", region comes back empty and instanceID is
+// everything after the scheme.
+func LogFields(providerID string) (region, instanceID string) {
+	scheme := Scheme(providerID)
+	rest := strings.TrimPrefix(providerID, scheme+"://")
+	rest = strings.TrimPrefix(rest, "/")
+	parts := strings.Split(rest, "/")
+	instanceID = parts[len(parts)-1]
+	if len(parts) < 2 {
+		return "", instanceID
+	}
+	az := parts[len(parts)-2]
+	if len(az) < 2 {
+		return "", instanceID
+	}
+	return az[:len(az)-1], instanceID
+}
@@ -0,0 +1,65 @@
+// Package metrics holds the Prometheus metrics shared between the
+// node-cleanup controller (package main) and its cloudprovider
+// implementations, so a provider package can record a metric for a call it
+// makes without importing package main.
+package metrics
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// CloudCallsTotal counts every cloud provider operation, from the
+	// logical operation boundary (e.g. "instance-exists", "attach",
+	// "detach") down to the individual EC2 verbs behind it (e.g.
+	// "describe-instances", "attach-volume"), so a throttled call nested
+	// inside a higher-level operation is still visible on its own.
+	CloudCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_node_cleanup_cloud_calls_total",
+		Help: "Cloud provider operations performed, by operation, outcome and AWS error code.",
+	}, []string{"operation", "outcome", "error_code"})
+	VolumeOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aws_node_cleanup_volume_operation_duration_seconds",
+		Help:    "Latency of cloud provider operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// errorCode extracts the AWS error code from err (e.g.
+// "RequestLimitExceeded" for EC2 throttling), so a spike in a specific
+// failure mode is visible without correlating logs. It returns "" for a nil
+// err and "other" for an error that didn't come from the AWS SDK (e.g. a
+// context cancellation).
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "other"
+}
+
+// ObserveCloudCall records the outcome of a single cloud provider operation
+// for the cloud_calls_total metric.
+func ObserveCloudCall(operation string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	CloudCallsTotal.WithLabelValues(operation, outcome, errorCode(err)).Inc()
+}
+
+// TimeCloudCall wraps a cloud provider call, recording both its latency and
+// its outcome.
+func TimeCloudCall(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	VolumeOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	ObserveCloudCall(operation, err)
+	return err
+}
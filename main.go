@@ -1,25 +1,76 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"os"
 	"os/user"
 	"path/filepath"
-	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
-
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider"
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider/aws"
+	"github.com/monder/aws-node-cleanup/internal/cloudprovider/kubevirt"
+)
+
+const (
+	resyncPeriod = 30 * time.Second
+	workers      = 2
+)
+
+var (
+	leaseLockName      = flag.String("lease-lock-name", "aws-node-cleanup", "name of the lease lock used for leader election")
+	leaseLockNamespace = flag.String("lease-lock-namespace", "kube-system", "namespace of the lease lock used for leader election")
+	legacyInTree       = flag.Bool("legacy-in-tree", false, "reconcile volume attachment by patching Node.status.volumesAttached directly, for clusters still on the in-tree kubernetes.io/aws-ebs provisioner, instead of driving VolumeAttachment objects as a CSI external-attacher would")
+
+	kubevirtInfraKubeconfig = flag.String("kubevirt-infra-kubeconfig", "", "kubeconfig for the infra cluster hosting tenant VirtualMachineInstances; enables the kubevirt:// cloud provider for Nodes whose providerID has that scheme")
+	kubevirtNamespace       = flag.String("kubevirt-namespace", "", "namespace in the infra cluster holding this tenant's VirtualMachineInstances")
+	kubevirtLabelSelector   = flag.String("kubevirt-label-selector", "", "label selector scoping this tenant's VirtualMachineInstances in the infra cluster")
+
+	awsEC2QPS   = flag.Float64("aws-ec2-qps", 10, "maximum EC2 API requests per second, shared across all regions")
+	awsEC2Burst = flag.Int("aws-ec2-burst", 20, "maximum EC2 API request burst size")
+
+	drainGracePeriod      = flag.Duration("drain-grace-period", -1, "grace period for pod eviction during a drain; negative uses each pod's own terminationGracePeriodSeconds")
+	drainForce            = flag.Bool("force", false, "continue draining a node even if it has pods not managed by a controller")
+	drainDeleteLocalData  = flag.Bool("delete-local-data", false, "continue draining a node even if it has pods using emptyDir volumes")
+	drainIgnoreDaemonSets = flag.Bool("ignore-daemonsets", true, "skip DaemonSet-managed pods instead of failing the drain on them")
+	drainTimeout          = flag.Duration("drain-timeout", 2*time.Minute, "how long to wait for evicted pods to terminate before giving up, or force-deleting them if the node's instance is confirmed gone")
+
+	metricsBindAddress = flag.String("metrics-bind-address", ":8080", "address to serve /metrics, /healthz and /readyz on")
 )
 
+// buildProviders registers a cloudprovider.Provider per providerID scheme
+// this invocation is configured to handle. AWS is always available;
+// KubeVirt is only registered when pointed at an infra cluster.
+func buildProviders() (map[string]cloudprovider.Provider, error) {
+	providers := map[string]cloudprovider.Provider{
+		"aws": aws.New(aws.Config{QPS: *awsEC2QPS, Burst: *awsEC2Burst}),
+	}
+	if *kubevirtInfraKubeconfig != "" {
+		kvProvider, err := kubevirt.New(kubevirt.Config{
+			InfraKubeconfig: *kubevirtInfraKubeconfig,
+			Namespace:       *kubevirtNamespace,
+			LabelSelector:   *kubevirtLabelSelector,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("configuring kubevirt cloud provider: %w", err)
+		}
+		providers["kubevirt"] = kvProvider
+	}
+	return providers, nil
+}
+
 func getConfig() (*rest.Config, error) {
 	// Try the in-cluster config
 	if c, err := rest.InClusterConfig(); err == nil {
@@ -35,72 +86,100 @@ func getConfig() (*rest.Config, error) {
 	return nil, fmt.Errorf("could not locate a kubeconfig")
 }
 
-func hasReadyCondition(conditions []corev1.NodeCondition) bool {
-	for _, condition := range conditions {
-		if condition.Type == corev1.NodeReady {
-			if condition.LastHeartbeatTime.After(time.Now().Add(-30 * time.Second)) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func shouldRemoveNode(node corev1.Node) bool {
-	providerID := node.Spec.ProviderID
-	parsedProviderID := strings.Split(providerID, "/")
-
-	region := node.Labels["failure-domain.beta.kubernetes.io/region"]
-	instanceID := parsedProviderID[len(parsedProviderID)-1]
-
-	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})))
-
-	result, err := svc.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{
-		InstanceIds: []*string{
-			aws.String(instanceID),
-		},
-	})
+func main() {
+	flag.Parse()
 
+	config, err := getConfig()
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == "InvalidInstanceID.NotFound" {
-				return true
-			}
-		}
-		log.Println(err)
-	} else if len(result.InstanceStatuses) == 0 {
-		return true
+		panic(err.Error())
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
 	}
-	return false
-
-}
 
-func main() {
-	config, err := getConfig()
+	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err.Error())
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	id := hostname + "_" + string(uuid.NewUUID())
+
+	providers, err := buildProviders()
 	if err != nil {
 		panic(err.Error())
 	}
-	for {
-		nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
-		if err != nil {
-			panic(err.Error())
-		}
-		for _, node := range nodes.Items {
-			if !hasReadyCondition(node.Status.Conditions) {
-				if shouldRemoveNode(node) {
-					log.Printf("Removing node %s\n", node.Name)
-					clientset.CoreV1().Nodes().Delete(node.Name, &metav1.DeleteOptions{})
-				} else {
-					log.Printf("Node %s seems unresponsive, but alive\n", node.Name)
-				}
-			}
-		}
-		time.Sleep(10 * time.Second)
+
+	drainOptions := DrainOptions{
+		GracePeriod:      *drainGracePeriod,
+		Force:            *drainForce,
+		DeleteLocalData:  *drainDeleteLocalData,
+		IgnoreDaemonSets: *drainIgnoreDaemonSets,
+		Timeout:          *drainTimeout,
+	}
+
+	startMetricsServer(*metricsBindAddress)
+
+	informerFactory := informers.NewSharedInformerFactory(clientset, resyncPeriod)
+	controller := NewController(clientset, informerFactory.Core().V1().Nodes(), providers, *legacyInTree, drainOptions)
+
+	var vaController *VolumeAttachmentController
+	if !*legacyInTree {
+		vaController = NewVolumeAttachmentController(clientset, informerFactory.Storage().V1().VolumeAttachments(), providers)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      *leaseLockName,
+			Namespace: *leaseLockNamespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
 	}
-}
\ No newline at end of file
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				setLeader(true)
+				informerFactory.Start(stopCh)
+				informerFactory.WaitForCacheSync(stopCh)
+
+				go func() {
+					if err := controller.Run(workers, stopCh); err != nil {
+						klog.ErrorS(err, "Controller exited")
+						os.Exit(1)
+					}
+				}()
+
+				if vaController != nil {
+					if err := vaController.Run(workers, stopCh); err != nil {
+						klog.ErrorS(err, "VolumeAttachment controller exited")
+						os.Exit(1)
+					}
+					return
+				}
+				<-stopCh
+			},
+			OnStoppedLeading: func() {
+				setLeader(false)
+				klog.InfoS("Leader lost, exiting", "identity", id)
+				os.Exit(0)
+			},
+			OnNewLeader: func(identity string) {
+				if identity == id {
+					return
+				}
+				klog.InfoS("New leader elected", "identity", identity)
+			},
+		},
+	})
+}
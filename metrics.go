@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+var (
+	reconcilesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aws_node_cleanup_reconciles_total",
+		Help: "Total number of Node reconcile passes.",
+	})
+	nodesDeletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aws_node_cleanup_nodes_deleted_total",
+		Help: "Total number of Nodes deleted because their backing instance disappeared.",
+	})
+)
+
+// leaderGauge reports 1 while this process holds the leader-election lease,
+// for the /readyz probe: a standby replica should not be reported ready to
+// receive traffic for work only the leader performs.
+var leaderGauge int32
+
+func setLeader(leading bool) {
+	if leading {
+		atomic.StoreInt32(&leaderGauge, 1)
+	} else {
+		atomic.StoreInt32(&leaderGauge, 0)
+	}
+}
+
+// startMetricsServer serves /metrics, /healthz and /readyz on addr until the
+// process exits. /healthz reports this process is alive; /readyz reports
+// whether it currently holds the leader-election lease.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&leaderGauge) == 0 {
+			http.Error(w, "not currently the elected leader", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			klog.ErrorS(err, "Metrics server exited")
+		}
+	}()
+}